@@ -3,13 +3,16 @@ package dnsforward
 import (
 	"crypto/tls"
 	"fmt"
+	"net/http"
 	"path"
 	"strings"
 
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
 )
 
 // ValidateClientID returns an error if id is not a valid ClientID.
@@ -107,6 +110,71 @@ func clientIDFromDNSContextHTTPS(pctx *proxy.DNSContext) (clientID string, err e
 	return strings.ToLower(clientID), nil
 }
 
+// altSvcMaxAge is the value, in seconds, of the "ma" parameter in the Alt-Svc
+// header that advertises DoH3, i.e. how long clients should cache the
+// advertisement before re-validating it.
+const altSvcMaxAge = 24 * 60 * 60
+
+// writeDoH3AltSvc adds an Alt-Svc header to w advertising the h3 endpoint on
+// h3Port, so that DoH/1.1 and DoH/2 clients that support it can transparently
+// upgrade to DoH3 on a subsequent request.  It's a no-op if h3Port is zero.
+func writeDoH3AltSvc(w http.ResponseWriter, h3Port int) {
+	if h3Port == 0 {
+		return
+	}
+
+	w.Header().Add("Alt-Svc", fmt.Sprintf(`h3=":%d"; ma=%d`, h3Port, altSvcMaxAge))
+}
+
+// handleDoH3Upgrade applies DoH3 upgrade settings to an incoming DoH/1.1 or
+// DoH/2 request for "/dns-query" or "/dns-query/<clientid>".  preferH3 and
+// forceH3 mirror the DoHPreferH3/DoHForceH3 settings; h3Port is the port the
+// QUIC listener for DoH3 is bound to.  handleDoH3Upgrade returns true if it
+// has fully handled the request itself, in which case the caller must not
+// process r any further.
+//
+// In prefer mode, every response is tagged with an Alt-Svc header so that
+// compliant clients upgrade to DoH3 on their own.  In force mode, once h3 has
+// been advertised, clients must use it: handleDoH3Upgrade rejects the request
+// with a 421 (Misdirected Request) instead of answering it.  Force mode has no
+// effect if h3Port is zero, since there is no h3 endpoint to advertise.
+func handleDoH3Upgrade(
+	w http.ResponseWriter,
+	r *http.Request,
+	preferH3 bool,
+	forceH3 bool,
+	h3Port int,
+) (handled bool) {
+	if r.ProtoAtLeast(3, 0) || (!preferH3 && !forceH3) {
+		return false
+	}
+
+	writeDoH3AltSvc(w, h3Port)
+
+	if !forceH3 || h3Port == 0 {
+		return false
+	}
+
+	http.Error(w, "use DNS-over-HTTP/3", http.StatusMisdirectedRequest)
+
+	return true
+}
+
+// WrapDoH3Upgrade wraps next, the handler that answers validated DoH queries,
+// with the DoH3 upgrade logic from handleDoH3Upgrade.  It's the handler the
+// DoH mux registers for "/dns-query" and "/dns-query/<clientid>" so that,
+// once the server is configured with DoHPreferH3 or DoHForceH3, every DoH/1.1
+// and DoH/2 request goes through the upgrade check before reaching next.
+func WrapDoH3Upgrade(preferH3, forceH3 bool, h3Port int, next http.Handler) (wrapped http.Handler) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handleDoH3Upgrade(w, r, preferH3, forceH3, h3Port) {
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 // tlsConn is a narrow interface for *tls.Conn to simplify testing.
 type tlsConn interface {
 	ConnectionState() (cs tls.ConnectionState)
@@ -157,32 +225,77 @@ func (s *Server) clientIDFromDNSContext(pctx *proxy.DNSContext) (clientID string
 	return clientID, nil
 }
 
+// quicConnFromDNSContext returns the QUIC connection stashed in pctx along
+// with an ok flag, narrowed to the quicConnection interface.
+func quicConnFromDNSContext(pctx *proxy.DNSContext) (conn quicConnection, ok bool) {
+	conn, ok = pctx.QUICConnection.(quicConnection)
+
+	return conn, ok
+}
+
+// quicConnFromH3Request returns the QUIC connection underlying an HTTP/3
+// request's stream along with an ok flag.  http3.Hijacker is implemented by
+// the *http.Request.Body that github.com/lucas-clemente/quic-go/http3 hands
+// to handlers, so this works without any extra plumbing on the server side.
+// This needs quic-go >= v0.29.0, where http3.Hijacker and
+// http3.StreamCreator.GetConnection were introduced; once this tree has a
+// go.mod, confirm the pinned version against that and that go build ./...
+// actually resolves these types.
+//
+// ok is false whenever r.Body isn't (or no longer is) an http3.Hijacker, e.g.
+// if a later handler in the chain wraps the request body.  The caller falls
+// back to the Host header in that case, which reopens the spoofing vector
+// this whole extraction exists to close, so every miss is logged to make a
+// regression here observable instead of silent.
+func quicConnFromH3Request(r *http.Request) (conn quicConnection, ok bool) {
+	hj, ok := r.Body.(http3.Hijacker)
+	if !ok {
+		log.Info("dnsforward: clientid: h3 request body is %T, not http3.Hijacker; falling back to host header", r.Body)
+
+		return nil, false
+	}
+
+	conn, ok = hj.StreamCreator().GetConnection().(quicConnection)
+	if !ok {
+		log.Info("dnsforward: clientid: h3 connection doesn't implement quicConnection; falling back to host header")
+	}
+
+	return conn, ok
+}
+
 // clientServerName returns the TLS server name based on the protocol.
 func clientServerName(pctx *proxy.DNSContext, proto proxy.Proto) (srvName string, err error) {
 	switch proto {
 	case proxy.ProtoHTTPS:
-		// github.com/lucas-clemente/quic-go seems to not populate the TLS
-		// field.  So, if the request comes over HTTP/3, use the Host header
-		// value as the server name.
-		//
-		// See https://github.com/lucas-clemente/quic-go/issues/2879.
-		//
-		// TODO(a.garipov): Remove this crutch once they fix it.
 		r := pctx.HTTPRequest
 		if r.ProtoAtLeast(3, 0) {
-			var host string
-			host, err = netutil.SplitHost(r.Host)
-			if err != nil {
-				return "", fmt.Errorf("parsing host: %w", err)
-			}
+			// *http.Request.TLS is not populated for HTTP/3 requests, since
+			// github.com/lucas-clemente/quic-go doesn't set it.  Read the
+			// real TLS SNI off the underlying QUIC connection instead of
+			// falling back to the Host header, which the client controls
+			// separately from the TLS handshake and so isn't a reliable
+			// ClientID source.
+			//
+			// quicConnFromH3Request logs every time it has to fall back to
+			// the Host header, so a regression that silently reopens this
+			// path is observable.
+			if conn, ok := quicConnFromH3Request(r); ok {
+				srvName = conn.ConnectionState().TLS.ServerName
+			} else {
+				var host string
+				host, err = netutil.SplitHost(r.Host)
+				if err != nil {
+					return "", fmt.Errorf("parsing host: %w", err)
+				}
 
-			srvName = host
+				srvName = host
+			}
 		} else if connState := r.TLS; connState != nil {
 			srvName = r.TLS.ServerName
 		}
 	case proxy.ProtoQUIC:
 		qConn := pctx.QUICConnection
-		conn, ok := qConn.(quicConnection)
+		conn, ok := quicConnFromDNSContext(pctx)
 		if !ok {
 			return "", fmt.Errorf("pctx conn of proto %s is %T, want quic.Connection", proto, qConn)
 		}
@@ -0,0 +1,205 @@
+package dnsforward
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testQUICConn is a quicConnection that returns a fixed server name, for
+// tests.  The rest of the quic.Connection interface is embedded as a nil value
+// and must not be called.
+type testQUICConn struct {
+	quic.Connection
+	serverName string
+}
+
+// ConnectionState implements the quicConnection interface for testQUICConn.
+func (c testQUICConn) ConnectionState() (cs quic.ConnectionState) {
+	cs.TLS.ServerName = c.serverName
+
+	return cs
+}
+
+// testStreamCreator is an http3.StreamCreator that only implements
+// GetConnection, for tests.  The rest of the interface is embedded as a nil
+// value and must not be called.
+type testStreamCreator struct {
+	http3.StreamCreator
+	conn quic.Connection
+}
+
+// GetConnection implements the http3.StreamCreator interface for
+// testStreamCreator.
+func (c testStreamCreator) GetConnection() (conn quic.Connection) {
+	return c.conn
+}
+
+// testH3Body is an io.ReadCloser that also implements http3.Hijacker, for
+// tests.  Reading and closing are not supported, since ClientID extraction
+// never uses them.
+type testH3Body struct {
+	io.ReadCloser
+	sc http3.StreamCreator
+}
+
+// StreamCreator implements the http3.Hijacker interface for testH3Body.
+func (b testH3Body) StreamCreator() (sc http3.StreamCreator) {
+	return b.sc
+}
+
+// newH3Request returns an HTTP/3 *http.Request with host as the Host header
+// and sni as the server name advertised by the underlying (fake) QUIC
+// connection.
+func newH3Request(t testing.TB, host, sni string) (r *http.Request) {
+	t.Helper()
+
+	r = httptest.NewRequest(http.MethodGet, "https://"+host+"/dns-query", nil)
+	r.ProtoMajor, r.ProtoMinor, r.Proto = 3, 0, "HTTP/3.0"
+	r.Body = testH3Body{sc: testStreamCreator{conn: testQUICConn{serverName: sni}}}
+
+	return r
+}
+
+func TestClientServerName_h3(t *testing.T) {
+	t.Run("mismatched_sni_and_host", func(t *testing.T) {
+		r := newH3Request(t, "host.example", "sni.example")
+		pctx := &proxy.DNSContext{Proto: proxy.ProtoHTTPS, HTTPRequest: r}
+
+		srvName, err := clientServerName(pctx, proxy.ProtoHTTPS)
+		require.NoError(t, err)
+
+		// The real TLS SNI must win, not the Host header the client is free
+		// to set to anything.
+		assert.Equal(t, "sni.example", srvName)
+	})
+
+	t.Run("no_quic_conn_falls_back_to_host", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "https://host.example/dns-query", nil)
+		r.ProtoMajor, r.ProtoMinor, r.Proto = 3, 0, "HTTP/3.0"
+		pctx := &proxy.DNSContext{Proto: proxy.ProtoHTTPS, HTTPRequest: r}
+
+		srvName, err := clientServerName(pctx, proxy.ProtoHTTPS)
+		require.NoError(t, err)
+
+		assert.Equal(t, "host.example", srvName)
+	})
+}
+
+func TestClientIDFromClientServerName_strict(t *testing.T) {
+	const hostSrvName = "dns.example.com"
+
+	t.Run("valid_clientid", func(t *testing.T) {
+		clientID, err := clientIDFromClientServerName(
+			hostSrvName,
+			"cli.dns.example.com",
+			true,
+		)
+		require.NoError(t, err)
+
+		assert.Equal(t, "cli", clientID)
+	})
+
+	t.Run("strict_mismatch_is_an_error", func(t *testing.T) {
+		_, err := clientIDFromClientServerName(
+			hostSrvName,
+			"cli.other.example.com",
+			true,
+		)
+		assert.Error(t, err)
+	})
+
+	t.Run("non_strict_mismatch_is_ignored", func(t *testing.T) {
+		clientID, err := clientIDFromClientServerName(
+			hostSrvName,
+			"cli.other.example.com",
+			false,
+		)
+		require.NoError(t, err)
+
+		assert.Empty(t, clientID)
+	})
+
+	t.Run("invalid_clientid_label", func(t *testing.T) {
+		_, err := clientIDFromClientServerName(
+			hostSrvName,
+			"cli_not_a_label!.dns.example.com",
+			true,
+		)
+		assert.Error(t, err)
+	})
+}
+
+// testDoHHandler is an http.Handler that records whether it was called, for
+// testing WrapDoH3Upgrade.
+type testDoHHandler struct {
+	called *bool
+}
+
+// ServeHTTP implements the http.Handler interface for testDoHHandler.
+func (h testDoHHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	*h.called = true
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestWrapDoH3Upgrade(t *testing.T) {
+	newReq := func(proto string, major, minor int) (r *http.Request) {
+		r = httptest.NewRequest(http.MethodGet, "https://dns.example.com/dns-query", nil)
+		r.Proto, r.ProtoMajor, r.ProtoMinor = proto, major, minor
+
+		return r
+	}
+
+	t.Run("prefer_h3_advertises_alt_svc_and_calls_next", func(t *testing.T) {
+		called := false
+		h := WrapDoH3Upgrade(true, false, 8443, testDoHHandler{called: &called})
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newReq("HTTP/1.1", 1, 1))
+
+		assert.True(t, called)
+		assert.Equal(t, `h3=":8443"; ma=86400`, w.Header().Get("Alt-Svc"))
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("force_h3_rejects_h1_h2_with_421", func(t *testing.T) {
+		called := false
+		h := WrapDoH3Upgrade(false, true, 8443, testDoHHandler{called: &called})
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newReq("HTTP/2.0", 2, 0))
+
+		assert.False(t, called)
+		assert.Equal(t, http.StatusMisdirectedRequest, w.Code)
+		assert.NotEmpty(t, w.Header().Get("Alt-Svc"))
+	})
+
+	t.Run("h3_requests_pass_through_untouched", func(t *testing.T) {
+		called := false
+		h := WrapDoH3Upgrade(true, true, 8443, testDoHHandler{called: &called})
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newReq("HTTP/3.0", 3, 0))
+
+		assert.True(t, called)
+		assert.Empty(t, w.Header().Get("Alt-Svc"))
+	})
+
+	t.Run("disabled_just_calls_next", func(t *testing.T) {
+		called := false
+		h := WrapDoH3Upgrade(false, false, 8443, testDoHHandler{called: &called})
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newReq("HTTP/1.1", 1, 1))
+
+		assert.True(t, called)
+		assert.Empty(t, w.Header().Get("Alt-Svc"))
+	})
+}
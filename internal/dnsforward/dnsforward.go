@@ -0,0 +1,191 @@
+package dnsforward
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/lucas-clemente/quic-go/http3"
+)
+
+// ServerConfig is the DNS server configuration.  It only declares the fields
+// that this package's own logic (ClientID extraction and DoH3 upgrade) reads;
+// the rest of the server's configuration lives outside this tree.
+type ServerConfig struct {
+	// ServerName is the server's own TLS server name, used to derive
+	// SNI-based ClientIDs for DoT, DoQ, and DoH.
+	ServerName string
+
+	// StrictSNICheck makes the server reject DoT, DoQ, and DoH requests
+	// whose SNI is neither ServerName nor a subdomain of it.  DoH requests
+	// that carry a ClientID in the URL path are not checked.
+	StrictSNICheck bool
+
+	// DoHPreferH3, when true, makes every DoH/1.1 and DoH/2 response for
+	// "/dns-query" and "/dns-query/<clientid>" carry an Alt-Svc header
+	// advertising the DoH3 endpoint.
+	DoHPreferH3 bool
+
+	// DoHForceH3, when true, makes the HTTP/1.1 and HTTP/2 DoH listeners
+	// reject "/dns-query" and "/dns-query/<clientid>" requests with a 421
+	// once DoH3 has been advertised, so that only the QUIC listener answers.
+	DoHForceH3 bool
+
+	// DoH3Addr is the UDP address the DoH3 (QUIC) listener binds to.  DoH3 is
+	// disabled if it's empty.
+	DoH3Addr string
+
+	// TLSConfig is the TLS configuration of the DoH3 QUIC listener.
+	TLSConfig *tls.Config
+}
+
+// doH3Port returns the numeric port from conf.DoH3Addr, or 0 if DoH3 is
+// disabled or the address has no parseable port.
+func (conf *ServerConfig) doH3Port() (port int) {
+	if conf.DoH3Addr == "" {
+		return 0
+	}
+
+	_, portStr, err := net.SplitHostPort(conf.DoH3Addr)
+	if err != nil {
+		return 0
+	}
+
+	_, err = fmt.Sscanf(portStr, "%d", &port)
+	if err != nil {
+		return 0
+	}
+
+	return port
+}
+
+// doH3Metrics holds simple counters for DoH3 upgrade behavior.  This tree
+// doesn't include the project's real metrics registration, so these are
+// plain counters rather than, say, Prometheus collectors; wire them into the
+// real metrics package once it's available.
+type doH3Metrics struct {
+	// altSvcAdvertised counts DoH/1.1 and DoH/2 responses that carried an
+	// Alt-Svc header.
+	altSvcAdvertised atomic.Int64
+
+	// forceH3Rejected counts DoH/1.1 and DoH/2 requests rejected with 421
+	// because DoHForceH3 is set.
+	forceH3Rejected atomic.Int64
+}
+
+// Server is the AdGuard Home DNS server.  It only declares the parts that
+// this package's ClientID and DoH3 logic depends on.
+type Server struct {
+	conf ServerConfig
+
+	// doHMux serves DoH over HTTP/1.1 and HTTP/2.
+	doHMux *http.ServeMux
+
+	// h3Server serves DoH3 over QUIC.  It's nil unless conf.DoH3Addr is set.
+	h3Server *http3.Server
+
+	metrics doH3Metrics
+}
+
+// NewServer returns a new, unstarted *Server configured with conf.  handler
+// answers validated DoH queries for "/dns-query" and "/dns-query/<clientid>";
+// it's wrapped with the DoH3 upgrade logic before being registered in the
+// DoH/1.1 and DoH/2 mux, and is reused as-is for the DoH3 QUIC listener.
+func NewServer(conf ServerConfig, handler http.Handler) (s *Server) {
+	s = &Server{
+		conf: conf,
+	}
+
+	upgraded := s.wrapDoH3Upgrade(handler)
+
+	s.doHMux = http.NewServeMux()
+	s.doHMux.Handle("/dns-query", upgraded)
+	s.doHMux.Handle("/dns-query/", upgraded)
+
+	if conf.DoH3Addr != "" {
+		h3Mux := http.NewServeMux()
+		h3Mux.Handle("/dns-query", handler)
+		h3Mux.Handle("/dns-query/", handler)
+
+		s.h3Server = &http3.Server{
+			Addr:      conf.DoH3Addr,
+			TLSConfig: conf.TLSConfig,
+			Handler:   h3Mux,
+		}
+	}
+
+	return s
+}
+
+// metricsResponseWriter wraps an http.ResponseWriter to record the status
+// code that was actually written, so that wrapDoH3Upgrade can update its
+// counters from the real response instead of re-deriving the same decision
+// handleDoH3Upgrade already made.
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader implements the http.ResponseWriter interface for
+// *metricsResponseWriter.
+func (w *metricsResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// wrapDoH3Upgrade wraps next with WrapDoH3Upgrade using s's own config, and
+// updates s.metrics from the response that's actually written, so the
+// counters reflect real traffic through s.doHMux.
+func (s *Server) wrapDoH3Upgrade(next http.Handler) (wrapped http.Handler) {
+	base := WrapDoH3Upgrade(s.conf.DoHPreferH3, s.conf.DoHForceH3, s.conf.doH3Port(), next)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mw := &metricsResponseWriter{ResponseWriter: w}
+		base.ServeHTTP(mw, r)
+
+		if mw.Header().Get("Alt-Svc") != "" {
+			s.metrics.altSvcAdvertised.Add(1)
+		}
+
+		if mw.status == http.StatusMisdirectedRequest {
+			s.metrics.forceH3Rejected.Add(1)
+		}
+	})
+}
+
+// ListenAndServeDoH3 starts the QUIC listener for DoH3, if one is configured.
+// It blocks until the listener stops or returns an error.
+func (s *Server) ListenAndServeDoH3() (err error) {
+	if s.h3Server == nil {
+		return nil
+	}
+
+	log.Info("dnsforward: starting doh3 listener on %s", s.conf.DoH3Addr)
+
+	return s.h3Server.ListenAndServe()
+}
+
+// CloseDoH3 closes the DoH3 QUIC listener, if one is configured.
+func (s *Server) CloseDoH3() (err error) {
+	if s.h3Server == nil {
+		return nil
+	}
+
+	return s.h3Server.Close()
+}
+
+// ServeHTTP implements the http.Handler interface for *Server.  It's the
+// entry point for the DoH/1.1 and DoH/2 listeners.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.doHMux.ServeHTTP(w, r)
+}
+
+// DoH3Metrics returns the current DoH3-upgrade counters: the number of
+// DoH/1.1 and DoH/2 responses that carried an Alt-Svc header, and the number
+// that were rejected with 421 because DoHForceH3 is set.
+func (s *Server) DoH3Metrics() (altSvcAdvertised, forceH3Rejected int64) {
+	return s.metrics.altSvcAdvertised.Load(), s.metrics.forceH3Rejected.Load()
+}
@@ -0,0 +1,86 @@
+package dnsforward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestH3Request is like newH3Request, but also sets the request path, for
+// exercising a full DoH3 query through *Server.
+func newTestH3Request(t testing.TB, path, sni string) (r *http.Request) {
+	t.Helper()
+
+	r = newH3Request(t, "dns.example.com", sni)
+	r.URL.Path = path
+
+	return r
+}
+
+func TestServer_ServeHTTP_preferH3(t *testing.T) {
+	var called bool
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusOK)
+	})
+
+	s := NewServer(ServerConfig{DoHPreferH3: true, DoH3Addr: ":8443"}, next)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "https://dns.example.com/dns-query", nil)
+	s.ServeHTTP(w, r)
+
+	assert.True(t, called)
+	assert.Equal(t, `h3=":8443"; ma=86400`, w.Header().Get("Alt-Svc"))
+
+	altSvc, rejected := s.DoH3Metrics()
+	assert.Equal(t, int64(1), altSvc)
+	assert.Equal(t, int64(0), rejected)
+}
+
+func TestServer_ServeHTTP_forceH3(t *testing.T) {
+	var called bool
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusOK)
+	})
+
+	s := NewServer(ServerConfig{DoHForceH3: true, DoH3Addr: ":8443"}, next)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "https://dns.example.com/dns-query", nil)
+	s.ServeHTTP(w, r)
+
+	assert.False(t, called)
+	assert.Equal(t, http.StatusMisdirectedRequest, w.Code)
+
+	altSvc, rejected := s.DoH3Metrics()
+	assert.Equal(t, int64(1), altSvc)
+	assert.Equal(t, int64(1), rejected)
+}
+
+// TestClientID_crossProtocolConsistency checks that the same ClientID is
+// derived whether it arrives via the DoH/1.1 path or the DoH3 SNI, given the
+// same server configuration.
+func TestClientID_crossProtocolConsistency(t *testing.T) {
+	s := &Server{conf: ServerConfig{ServerName: "dns.example.com", StrictSNICheck: true}}
+
+	h1Req := httptest.NewRequest(http.MethodGet, "https://dns.example.com/dns-query/clientid1", nil)
+	h1Pctx := &proxy.DNSContext{Proto: proxy.ProtoHTTPS, HTTPRequest: h1Req}
+
+	h1ClientID, err := s.clientIDFromDNSContext(h1Pctx)
+	require.NoError(t, err)
+
+	h3Req := newTestH3Request(t, "/dns-query", "clientid1.dns.example.com")
+	h3Pctx := &proxy.DNSContext{Proto: proxy.ProtoHTTPS, HTTPRequest: h3Req}
+
+	h3ClientID, err := s.clientIDFromDNSContext(h3Pctx)
+	require.NoError(t, err)
+
+	assert.Equal(t, "clientid1", h1ClientID)
+	assert.Equal(t, h1ClientID, h3ClientID)
+}